@@ -0,0 +1,277 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// downloadExtensions resolves and downloads every extension in o.Extensions
+// using a pool of o.Parallel workers, deduplicating concurrent downloads of
+// the same XPI URL. lock is updated in place; the caller persists it.
+// Per-extension errors are joined and returned, unless o.Strict cancels
+// everything on the first error.
+func downloadExtensions(ctx context.Context, client *http.Client, o options, lock *lockFile, profileExtensionsDirPath string) (lockDirty bool, err error) {
+	parallel := o.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slugs := make(chan string)
+	go func() {
+		defer close(slugs)
+		for slug := range o.Extensions {
+			select {
+			case slugs <- slug:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		mu       sync.Mutex
+		errs     []error
+		inflight sync.Map // xpiURL -> chan struct{}, closed once that URL has been fetched
+		progress = newProgressReporter()
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for slug := range slugs {
+				dirty, err := downloadExtension(ctx, client, o, lock, &mu, &inflight, progress, profileExtensionsDirPath, slug)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("extension %s: %s", slug, err))
+				} else if dirty {
+					lockDirty = true
+				}
+				mu.Unlock()
+				if err != nil && o.Strict {
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	progress.done()
+
+	// clean up the shared per-URL temp files now that every slug referencing them has been copied out
+	inflight.Range(func(key, _ any) bool {
+		xpiURL := key.(string)
+		sharedPath := filepath.Join(profileExtensionsDirPath, fmt.Sprintf(".shared-%x.xpi", sha256Sum([]byte(xpiURL))[:8]))
+		_ = os.Remove(sharedPath)
+		return true
+	})
+
+	return lockDirty, errors.Join(errs...)
+}
+
+// downloadExtension resolves, downloads, verifies and installs a single
+// extension. extensionArg is whatever the user passed to -ext: an AMO slug,
+// an https:// URL, a "store:slug" reference to a -ext-source, or a local
+// .xpi path.
+func downloadExtension(ctx context.Context, client *http.Client, o options, lock *lockFile, mu *sync.Mutex, inflight *sync.Map, progress *progressReporter, profileExtensionsDirPath, extensionArg string) (dirty bool, err error) {
+	mu.Lock()
+	lockEntry, locked := lock.Extensions[extensionArg]
+	mu.Unlock()
+	if !locked && o.Frozen {
+		return false, fmt.Errorf("-frozen was given but lock file %s has no entry for this extension", o.LockPath)
+	}
+
+	kind, location := resolveExtensionSource(extensionArg, o.ExtSources)
+
+	// a local .xpi needs neither page scraping nor a network fetch: read it in place
+	if kind == extensionSourceFile {
+		return installExtensionFromFile(location, lock, mu, extensionArg, lockEntry, locked, o, profileExtensionsDirPath)
+	}
+
+	extensionXpiURL := lockEntry.URL
+	if !locked || o.UpdateLock {
+		switch kind {
+		case extensionSourceURL:
+			extensionXpiURL = location
+		default: // extensionSourceAMO
+			extensionPageURL := "https://addons.mozilla.org/en-US/firefox/addon/" + extensionArg + "/"
+			logger.Debug("visiting extension page", slog.String("slug", extensionArg), slog.String("url", extensionPageURL))
+			pageHTML, err := openURLHTML(ctx, client, extensionPageURL)
+			if err != nil {
+				return false, fmt.Errorf("cannot open url %s - error: %s", extensionPageURL, err)
+			}
+			extensionGUID, err := extractGUIDFromHTML(pageHTML)
+			if err != nil {
+				return false, fmt.Errorf("failed to extract GUID from html: %s", err)
+			}
+			lockEntry.GUID = extensionGUID
+			extensionLatestURL := "https://addons.mozilla.org/firefox/downloads/latest/" + extensionArg + "/" + extensionArg + ".xpi"
+			extensionXpiURL, err = resolveVersionedXPIURL(ctx, client, extensionLatestURL)
+			if err != nil {
+				return false, fmt.Errorf("failed to resolve versioned download url for %s: %s", extensionArg, err)
+			}
+		}
+	}
+
+	// deduplicate concurrent downloads of the same XPI URL: the first
+	// goroutine to see this URL fetches it, the rest wait for it to finish
+	done := make(chan struct{})
+	actual, alreadyInflight := inflight.LoadOrStore(extensionXpiURL, done)
+	extensionXpiSharedPath := filepath.Join(profileExtensionsDirPath, fmt.Sprintf(".shared-%x.xpi", sha256Sum([]byte(extensionXpiURL))[:8]))
+	if alreadyInflight {
+		<-actual.(chan struct{})
+	} else {
+		defer close(done)
+		logger.Info("downloading extension", slog.String("slug", extensionArg), slog.String("url", extensionXpiURL), slog.String("path", extensionXpiSharedPath))
+		err := downloadFile(ctx, client, extensionXpiURL, extensionXpiSharedPath, func(p GenericProgress) {
+			progress.update(extensionArg, p)
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to download extension from url %s - error: %s", extensionXpiURL, err)
+		}
+	}
+	if _, err := os.Stat(extensionXpiSharedPath); err != nil {
+		return false, fmt.Errorf("shared download of %s did not succeed: %s", extensionXpiURL, err)
+	}
+
+	return verifyAndInstallExtension(extensionXpiSharedPath, extensionXpiURL, lock, mu, extensionArg, lockEntry, locked, o, profileExtensionsDirPath)
+}
+
+// resolveVersionedXPIURL follows the redirect chain starting at latestURL
+// (AMO's /firefox/downloads/latest/ endpoint) and returns the final,
+// versioned URL it lands on.
+func resolveVersionedXPIURL(ctx context.Context, client *http.Client, latestURL string) (string, error) {
+	noRedirectClient := &http.Client{
+		Transport: client.Transport,
+		Timeout:   client.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	current := latestURL
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, current, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to build request for %s: %s", current, err)
+		}
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch %s: %s", current, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+			return current, nil
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return "", fmt.Errorf("redirect response from %s had no Location header", current)
+		}
+		locationURL, err := req.URL.Parse(location)
+		if err != nil {
+			return "", fmt.Errorf("invalid redirect Location %q from %s: %s", location, current, err)
+		}
+		current = locationURL.String()
+	}
+	return "", fmt.Errorf("too many redirects resolving %s", latestURL)
+}
+
+// installExtensionFromFile installs an extension whose source is a local
+// .xpi path: there is nothing to download, so it goes straight to
+// verification and installation.
+func installExtensionFromFile(path string, lock *lockFile, mu *sync.Mutex, extensionArg string, lockEntry lockExtensionEntry, locked bool, o options, profileExtensionsDirPath string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, fmt.Errorf("local extension path %s is not accessible: %s", path, err)
+	}
+	return verifyAndInstallExtension(path, path, lock, mu, extensionArg, lockEntry, locked, o, profileExtensionsDirPath)
+}
+
+// verifyAndInstallExtension verifies xpiPath against the lock entry (if
+// locked), double-checks its GUID, updates the lock entry if needed, and
+// copies it into profileExtensionsDirPath under its GUID. recordURL is
+// stored as the lock entry's URL.
+func verifyAndInstallExtension(xpiPath, recordURL string, lock *lockFile, mu *sync.Mutex, extensionArg string, lockEntry lockExtensionEntry, locked bool, o options, profileExtensionsDirPath string) (dirty bool, err error) {
+	if locked && !o.UpdateLock {
+		if err := verifySHA256File(xpiPath, lockEntry.SHA256); err != nil {
+			return false, fmt.Errorf("failed verification against lock file: %s", err)
+		}
+	}
+
+	// double-check the GUID inside the XPI against the lock entry / page scrape
+	extensionGUID, err := extractGUIDFromXPI(xpiPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to extract GUID from XPI: %s", err)
+	}
+	if lockEntry.GUID != "" && extensionGUID != lockEntry.GUID {
+		return false, fmt.Errorf("GUID mismatch: expected %s, got %s", lockEntry.GUID, extensionGUID)
+	}
+	lockEntry.GUID = extensionGUID
+
+	if !locked || o.UpdateLock {
+		xpiInfo, err := os.Stat(xpiPath)
+		if err != nil {
+			return false, fmt.Errorf("failed to stat extension: %s", err)
+		}
+		xpiSHA256, err := sha256File(xpiPath)
+		if err != nil {
+			return false, fmt.Errorf("failed to hash extension: %s", err)
+		}
+		lockEntry.URL = recordURL
+		lockEntry.Size = xpiInfo.Size()
+		lockEntry.SHA256 = xpiSHA256
+		dirty = true
+	}
+
+	mu.Lock()
+	lock.Extensions[extensionArg] = lockEntry
+	mu.Unlock()
+
+	// copy (rather than rename) into its final, GUID-named destination,
+	// since multiple -ext arguments may point at the same underlying file
+	extensionXpiDownloadPath := filepath.Join(profileExtensionsDirPath, extensionGUID+".xpi")
+	if err := copyFile(xpiPath, extensionXpiDownloadPath); err != nil {
+		return false, fmt.Errorf("failed to place extension at %s: %s", extensionXpiDownloadPath, err)
+	}
+	logger.Debug("installed extension", slog.String("slug", extensionArg), slog.String("guid", extensionGUID))
+
+	return dirty, nil
+}
+
+// copyFile copies src to dst, writing to a temp file next to dst first and
+// renaming it into place on success, so dst never exists half-written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", src, err)
+	}
+	defer in.Close()
+	// a unique temp name, so concurrent copies to the same dst don't share one
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %s", dst, err)
+	}
+	tmpDst := out.Name()
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %s", src, tmpDst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %s", tmpDst, err)
+	}
+	if err := os.Rename(tmpDst, dst); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %s", tmpDst, dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeXPI builds a minimal, valid .xpi (a zip containing manifest.json) whose
+// manifest declares guid as its extension ID, as extractGUIDFromXPI expects.
+func fakeXPI(t *testing.T, guid string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("manifest.json")
+	if err != nil {
+		t.Fatalf("failed to create manifest.json in fake xpi: %s", err)
+	}
+	if _, err := f.Write([]byte(`{"applications":{"gecko":{"id":"` + guid + `"}}}`)); err != nil {
+		t.Fatalf("failed to write manifest.json in fake xpi: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close fake xpi: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func testOptions() options {
+	return options{
+		Extensions: make(setOfStrings),
+		ExtSources: make(extensionSourceMap),
+		Parallel:   4,
+	}
+}
+
+// TestDownloadExtensionsDedupesByURL checks that two -ext arguments which
+// resolve to the same XPI URL share a single HTTP fetch.
+func TestDownloadExtensionsDedupesByURL(t *testing.T) {
+	var requests atomic.Int64
+	xpi := fakeXPI(t, "shared@example.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(xpi)
+	}))
+	defer srv.Close()
+
+	o := testOptions()
+	o.ExtSources["store"] = srv.URL + "/shared.xpi"
+	o.Extensions["store:a"] = struct{}{}
+	o.Extensions["store:b"] = struct{}{}
+
+	lock := newLockFile()
+	profileExtensionsDir := t.TempDir()
+
+	_, err := downloadExtensions(context.Background(), &http.Client{}, o, lock, profileExtensionsDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("expected exactly 1 HTTP request for the shared URL, got %d", got)
+	}
+	if len(lock.Extensions) != 2 {
+		t.Fatalf("expected 2 lock entries, got %d", len(lock.Extensions))
+	}
+}
+
+// TestDownloadExtensionsNonStrictContinuesOnError checks that, without
+// -strict, a failing extension doesn't prevent the others from being
+// installed; the error is still reported to the caller.
+func TestDownloadExtensionsNonStrictContinuesOnError(t *testing.T) {
+	xpi := fakeXPI(t, "ok@example.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.xpi" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(xpi)
+	}))
+	defer srv.Close()
+
+	o := testOptions()
+	o.ExtSources["store"] = srv.URL + "/{slug}.xpi"
+	o.Extensions["store:ok"] = struct{}{}
+	o.Extensions["store:missing"] = struct{}{}
+
+	lock := newLockFile()
+	profileExtensionsDir := t.TempDir()
+
+	_, err := downloadExtensions(context.Background(), &http.Client{}, o, lock, profileExtensionsDir)
+	if err == nil {
+		t.Fatal("expected an error from the failing extension")
+	}
+	if _, ok := lock.Extensions["store:ok"]; !ok {
+		t.Fatal("expected the succeeding extension to be installed despite the other one failing")
+	}
+	if _, ok := lock.Extensions["store:missing"]; ok {
+		t.Fatal("did not expect a lock entry for the failing extension")
+	}
+}
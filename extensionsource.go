@@ -0,0 +1,62 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// extensionSourceKind classifies how an -ext argument should be fetched.
+type extensionSourceKind int
+
+const (
+	// extensionSourceAMO is a bare slug, resolved against addons.mozilla.org.
+	extensionSourceAMO extensionSourceKind = iota
+	// extensionSourceURL is an http:// or https:// URL to an XPI file, given
+	// directly or built from a registered -ext-source template.
+	extensionSourceURL
+	// extensionSourceFile is a filesystem path to a local .xpi file.
+	extensionSourceFile
+)
+
+// extensionSourceMap holds user-registered `-ext-source name=url-template`
+// stores, referenced from -ext as "name:slug".
+type extensionSourceMap map[string]string
+
+func (m *extensionSourceMap) String() string {
+	return ""
+}
+
+func (m *extensionSourceMap) Set(v string) error {
+	name, template, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("invalid -ext-source value %q, expected name=url-template", v)
+	}
+	if name == "" || template == "" {
+		return fmt.Errorf("invalid -ext-source value %q, expected name=url-template", v)
+	}
+	(*m)[name] = template
+	return nil
+}
+
+// resolveExtensionSource classifies an -ext argument and, where possible,
+// returns the URL or local path to fetch its XPI from.
+func resolveExtensionSource(extensionArg string, sources extensionSourceMap) (kind extensionSourceKind, location string) {
+	if strings.HasPrefix(extensionArg, "https://") || strings.HasPrefix(extensionArg, "http://") {
+		return extensionSourceURL, extensionArg
+	}
+	if storeName, slug, ok := strings.Cut(extensionArg, ":"); ok {
+		if template, registered := sources[storeName]; registered {
+			return extensionSourceURL, strings.ReplaceAll(template, "{slug}", slug)
+		}
+	}
+	if strings.HasSuffix(extensionArg, ".xpi") {
+		if info, err := os.Stat(extensionArg); err == nil && !info.IsDir() {
+			return extensionSourceFile, extensionArg
+		}
+	}
+	return extensionSourceAMO, ""
+}
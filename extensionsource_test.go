@@ -0,0 +1,81 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveExtensionSource(t *testing.T) {
+	localXpi := filepath.Join(t.TempDir(), "extension.xpi")
+	if err := os.WriteFile(localXpi, []byte("fake xpi"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", localXpi, err)
+	}
+
+	sources := extensionSourceMap{
+		"github": "https://github.com/{slug}/releases/latest/download/{slug}.xpi",
+	}
+
+	tests := []struct {
+		name         string
+		extensionArg string
+		wantKind     extensionSourceKind
+		wantLocation string
+	}{
+		{
+			name:         "amo slug",
+			extensionArg: "ublock-origin",
+			wantKind:     extensionSourceAMO,
+			wantLocation: "",
+		},
+		{
+			name:         "https url",
+			extensionArg: "https://example.com/ext.xpi",
+			wantKind:     extensionSourceURL,
+			wantLocation: "https://example.com/ext.xpi",
+		},
+		{
+			name:         "http url",
+			extensionArg: "http://example.com/ext.xpi",
+			wantKind:     extensionSourceURL,
+			wantLocation: "http://example.com/ext.xpi",
+		},
+		{
+			name:         "registered store",
+			extensionArg: "github:my-fork",
+			wantKind:     extensionSourceURL,
+			wantLocation: "https://github.com/my-fork/releases/latest/download/my-fork.xpi",
+		},
+		{
+			name:         "unregistered store falls back to amo",
+			extensionArg: "nosuchstore:my-fork",
+			wantKind:     extensionSourceAMO,
+			wantLocation: "",
+		},
+		{
+			name:         "local xpi path",
+			extensionArg: localXpi,
+			wantKind:     extensionSourceFile,
+			wantLocation: localXpi,
+		},
+		{
+			name:         "nonexistent xpi path falls back to amo",
+			extensionArg: filepath.Join(t.TempDir(), "missing.xpi"),
+			wantKind:     extensionSourceAMO,
+			wantLocation: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, location := resolveExtensionSource(tt.extensionArg, sources)
+			if kind != tt.wantKind {
+				t.Errorf("kind = %v, want %v", kind, tt.wantKind)
+			}
+			if location != tt.wantLocation {
+				t.Errorf("location = %q, want %q", location, tt.wantLocation)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// firefoxRelease describes the version and release channel of an installed
+// Firefox binary, as reported by `firefox --version`.
+type firefoxRelease struct {
+	Major   int
+	Minor   int
+	Channel string // "release", "beta", "nightly" or "esr"
+}
+
+// firefoxVersionRegexp matches the version line of `firefox --version` across
+// release, beta/Developer Edition, Nightly and ESR builds, e.g.:
+//
+//	Mozilla Firefox 124.0.1
+//	Mozilla Firefox 115.9.0esr
+//	Mozilla Firefox Nightly 125.0a1
+//	Mozilla Firefox Developer Edition 124.0b9
+var firefoxVersionRegexp = regexp.MustCompile(`(?i)Firefox\s+(?:(Nightly|Developer Edition)\s+)?([0-9]+)\.([0-9]+)(?:\.[0-9]+)?([ab][0-9]+)?(esr)?`)
+
+func parseFirefoxVersion(output []byte) (firefoxRelease, error) {
+	matches := firefoxVersionRegexp.FindSubmatch(output)
+	if matches == nil {
+		return firefoxRelease{}, fmt.Errorf("failed to parse firefox version from output: %q", output)
+	}
+	major, err := strconv.Atoi(string(matches[2]))
+	if err != nil {
+		return firefoxRelease{}, fmt.Errorf("failed to parse firefox major version: %s", err)
+	}
+	minor, err := strconv.Atoi(string(matches[3]))
+	if err != nil {
+		return firefoxRelease{}, fmt.Errorf("failed to parse firefox minor version: %s", err)
+	}
+	channelWord := strings.ToLower(string(matches[1]))
+	prerelease := string(matches[4])
+	esr := string(matches[5])
+	var channel string
+	switch {
+	case esr != "":
+		channel = "esr"
+	case channelWord == "nightly" || strings.HasPrefix(prerelease, "a"):
+		channel = "nightly"
+	case channelWord == "developer edition" || strings.HasPrefix(prerelease, "b"):
+		channel = "beta"
+	default:
+		channel = "release"
+	}
+	return firefoxRelease{Major: major, Minor: minor, Channel: channel}, nil
+}
+
+// firefoxBinEnvVar overrides Firefox binary discovery; takes precedence over
+// standard install locations but not over -firefox.
+const firefoxBinEnvVar = "FIREFOX_BIN"
+
+// resolveFirefoxBin returns the -firefox flag if given, otherwise the result of findFirefox().
+func resolveFirefoxBin(firefoxFlag string) (string, error) {
+	if firefoxFlag != "" {
+		if _, err := os.Stat(firefoxFlag); err != nil {
+			return "", fmt.Errorf("-firefox path %s is not accessible: %s", firefoxFlag, err)
+		}
+		return firefoxFlag, nil
+	}
+	return findFirefox()
+}
+
+// firstAccessiblePath returns the first path in candidates that exists, or
+// an error listing all of them if none does.
+func firstAccessiblePath(candidates []string) (string, error) {
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("firefox not found in any of: %s", strings.Join(candidates, ", "))
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+//go:build darwin
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// findFirefox locates the Firefox binary on macOS: FIREFOX_BIN, then the
+// standard /Applications install locations, then PATH.
+func findFirefox() (string, error) {
+	if bin := os.Getenv(firefoxBinEnvVar); bin != "" {
+		return bin, nil
+	}
+	candidates := []string{
+		"/Applications/Firefox.app/Contents/MacOS/firefox",
+		"/Applications/Firefox Nightly.app/Contents/MacOS/firefox",
+		"/Applications/Firefox Developer Edition.app/Contents/MacOS/firefox",
+		filepath.Join(os.Getenv("HOME"), "Applications/Firefox.app/Contents/MacOS/firefox"),
+	}
+	if path, err := firstAccessiblePath(candidates); err == nil {
+		return path, nil
+	}
+	return exec.LookPath("firefox")
+}
@@ -0,0 +1,28 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// findFirefox locates the Firefox binary on Linux: FIREFOX_BIN, then PATH,
+// then the handful of locations distro packages and the Mozilla tarball use.
+func findFirefox() (string, error) {
+	if bin := os.Getenv(firefoxBinEnvVar); bin != "" {
+		return bin, nil
+	}
+	if path, err := exec.LookPath("firefox"); err == nil {
+		return path, nil
+	}
+	return firstAccessiblePath([]string{
+		"/usr/bin/firefox",
+		"/usr/local/bin/firefox",
+		"/snap/bin/firefox",
+		"/opt/firefox/firefox",
+	})
+}
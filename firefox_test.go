@@ -0,0 +1,51 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+package main
+
+import "testing"
+
+func TestParseFirefoxVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   firefoxRelease
+	}{
+		{
+			name:   "release",
+			output: "Mozilla Firefox 124.0.1\n",
+			want:   firefoxRelease{Major: 124, Minor: 0, Channel: "release"},
+		},
+		{
+			name:   "esr",
+			output: "Mozilla Firefox 115.9.0esr\n",
+			want:   firefoxRelease{Major: 115, Minor: 9, Channel: "esr"},
+		},
+		{
+			name:   "nightly",
+			output: "Mozilla Firefox Nightly 125.0a1\n",
+			want:   firefoxRelease{Major: 125, Minor: 0, Channel: "nightly"},
+		},
+		{
+			name:   "developer edition",
+			output: "Mozilla Firefox Developer Edition 124.0b9\n",
+			want:   firefoxRelease{Major: 124, Minor: 0, Channel: "beta"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFirefoxVersion([]byte(tt.output))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFirefoxVersionInvalid(t *testing.T) {
+	if _, err := parseFirefoxVersion([]byte("not a firefox version string")); err == nil {
+		t.Fatal("expected an error for unparseable output")
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// findFirefox locates the Firefox binary on Windows: FIREFOX_BIN, then the
+// standard Program Files / per-user install locations, then PATH.
+func findFirefox() (string, error) {
+	if bin := os.Getenv(firefoxBinEnvVar); bin != "" {
+		return bin, nil
+	}
+	candidates := []string{
+		filepath.Join(os.Getenv("ProgramFiles"), "Mozilla Firefox", "firefox.exe"),
+		filepath.Join(os.Getenv("ProgramFiles(x86)"), "Mozilla Firefox", "firefox.exe"),
+		filepath.Join(os.Getenv("LocalAppData"), "Mozilla Firefox", "firefox.exe"),
+	}
+	if path, err := firstAccessiblePath(candidates); err == nil {
+		return path, nil
+	}
+	return exec.LookPath("firefox.exe")
+}
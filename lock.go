@@ -0,0 +1,95 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// lockExtensionEntry pins a single extension to a specific XPI artefact.
+type lockExtensionEntry struct {
+	GUID   string `json:"guid"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// lockFile pins the exact versions of user.js and the extensions so that a
+// profile can be reproduced byte-for-byte on another machine.
+type lockFile struct {
+	ArkenfoxTag    string                        `json:"arkenfoxTag,omitempty"`
+	ArkenfoxSHA256 string                        `json:"arkenfoxSha256,omitempty"`
+	Extensions     map[string]lockExtensionEntry `json:"extensions"`
+}
+
+func newLockFile() *lockFile {
+	return &lockFile{Extensions: make(map[string]lockExtensionEntry)}
+}
+
+// loadLockFile reads a lockFile from path, or returns an empty one if it doesn't exist yet.
+func loadLockFile(path string) (*lockFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newLockFile(), nil
+		}
+		return nil, fmt.Errorf("failed to read lock file %s: %s", path, err)
+	}
+	l := newLockFile()
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lock file %s: %s", path, err)
+	}
+	if l.Extensions == nil {
+		l.Extensions = make(map[string]lockExtensionEntry)
+	}
+	return l, nil
+}
+
+func (l *lockFile) save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock file: %s", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write lock file %s: %s", path, err)
+	}
+	return nil
+}
+
+// sha256File returns the lowercase hex-encoded SHA-256 digest of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %s", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %s", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256Sum returns the raw SHA-256 digest of data.
+func sha256Sum(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// verifySHA256File checks that the file at path hashes to expectedSHA256.
+func verifySHA256File(path, expectedSHA256 string) error {
+	actual, err := sha256File(path)
+	if err != nil {
+		return err
+	}
+	if actual != expectedSHA256 {
+		return fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", path, expectedSHA256, actual)
+	}
+	return nil
+}
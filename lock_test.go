@@ -0,0 +1,79 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadLockFileMissingReturnsEmpty(t *testing.T) {
+	l, err := loadLockFile(filepath.Join(t.TempDir(), "tmpfox.lock"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l.Extensions == nil || len(l.Extensions) != 0 {
+		t.Fatalf("expected an empty, non-nil Extensions map, got %#v", l.Extensions)
+	}
+}
+
+func TestLockFileSaveAndLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tmpfox.lock")
+
+	original := newLockFile()
+	original.ArkenfoxTag = "126.0"
+	original.ArkenfoxSHA256 = "deadbeef"
+	original.Extensions["ublock-origin"] = lockExtensionEntry{
+		GUID:   "uBlock0@raymondhill.net",
+		URL:    "https://addons.mozilla.org/firefox/downloads/file/123456/ublock_origin-1.2.3.xpi",
+		Size:   123456,
+		SHA256: "0123456789abcdef",
+	}
+
+	if err := original.save(path); err != nil {
+		t.Fatalf("save: unexpected error: %s", err)
+	}
+
+	loaded, err := loadLockFile(path)
+	if err != nil {
+		t.Fatalf("loadLockFile: unexpected error: %s", err)
+	}
+
+	if loaded.ArkenfoxTag != original.ArkenfoxTag {
+		t.Errorf("ArkenfoxTag = %q, want %q", loaded.ArkenfoxTag, original.ArkenfoxTag)
+	}
+	if loaded.ArkenfoxSHA256 != original.ArkenfoxSHA256 {
+		t.Errorf("ArkenfoxSHA256 = %q, want %q", loaded.ArkenfoxSHA256, original.ArkenfoxSHA256)
+	}
+	entry, ok := loaded.Extensions["ublock-origin"]
+	if !ok {
+		t.Fatalf("expected an extensions entry for ublock-origin")
+	}
+	if entry != original.Extensions["ublock-origin"] {
+		t.Errorf("got entry %+v, want %+v", entry, original.Extensions["ublock-origin"])
+	}
+}
+
+func TestSha256FileAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("hello world"), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+
+	sum, err := sha256File(path)
+	if err != nil {
+		t.Fatalf("sha256File: unexpected error: %s", err)
+	}
+	const wantSHA256 = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	if sum != wantSHA256 {
+		t.Fatalf("sha256File = %q, want %q", sum, wantSHA256)
+	}
+
+	if err := verifySHA256File(path, wantSHA256); err != nil {
+		t.Fatalf("verifySHA256File: unexpected error: %s", err)
+	}
+	if err := verifySHA256File(path, "0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("expected an error for a mismatched sha256")
+	}
+}
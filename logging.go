@@ -0,0 +1,87 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// logger is the package-level structured logger.
+var logger = slog.Default()
+
+// newLogger builds a *slog.Logger writing to stderr in the given format and level.
+func newLogger(format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	switch level {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "info":
+		lvl = slog.LevelInfo
+	case "warn":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		return nil, fmt.Errorf("invalid -log-level %q, expected debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q, expected text or json", format)
+	}
+	return slog.New(handler), nil
+}
+
+// withPhase logs the start and outcome of one of run()'s phases.
+func withPhase(stage string, fn func() error) error {
+	start := time.Now()
+	logger.Debug("phase started", slog.String("stage", stage))
+	err := fn()
+	if err != nil {
+		logger.Error("phase failed", slog.String("stage", stage), slog.Duration("elapsed", time.Since(start)), slog.String("error", err.Error()))
+	} else {
+		logger.Info("phase finished", slog.String("stage", stage), slog.Duration("elapsed", time.Since(start)))
+	}
+	return err
+}
+
+// lineLogger is an io.Writer that splits what's written to it into lines and
+// logs each one through logger, tagged with stage and stream.
+type lineLogger struct {
+	stage  string
+	stream string
+	buf    bytes.Buffer
+}
+
+func (w *lineLogger) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// incomplete line: put it back for the next Write, and stop
+			w.buf.WriteString(line)
+			break
+		}
+		logger.Info(strings.TrimRight(line, "\r\n"), slog.String("stage", w.stage), slog.String("stream", w.stream))
+	}
+	return len(p), nil
+}
+
+// flush logs whatever incomplete line is left in the buffer, if any.
+func (w *lineLogger) flush() {
+	if w.buf.Len() > 0 {
+		logger.Info(w.buf.String(), slog.String("stage", w.stage), slog.String("stream", w.stream))
+		w.buf.Reset()
+	}
+}
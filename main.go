@@ -12,7 +12,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
@@ -46,6 +46,16 @@ type options struct {
 	UserJsURL      string
 	Extensions     setOfStrings
 	ExtensionNoRec bool
+	LockPath       string
+	Frozen         bool
+	UpdateLock     bool
+	Parallel       int
+	Strict         bool
+	FirefoxBin     string
+	RandomUA       bool
+	ExtSources     extensionSourceMap
+	LogFormat      string
+	LogLevel       string
 }
 
 const notSetUserJsURL = "matching arkenfox version"
@@ -54,13 +64,24 @@ func main() {
 	runtime.GOMAXPROCS(1)
 	var o options
 	o.Extensions = make(setOfStrings)
+	o.ExtSources = make(extensionSourceMap)
 	flag.BoolVar(&o.Help, "h", false, "Print usage")
 	flag.BoolVar(&o.License, "license", false, "Licensing information")
 	flag.StringVar(&o.ProfilesDir, "dir", filepath.Join(os.TempDir(), appName), "Profiles' directory")
 	flag.BoolVar(&o.Keep, "keep", false, "Do not delete profile on exit")
 	flag.StringVar(&o.UserJsURL, "userjs", notSetUserJsURL, "user.js download URL. If not set, download an arkenfox version matching the installed firefox version. If set to empty, do not download user.js.")
-	flag.Var(&o.Extensions, "ext", "Extension to install in the profile. Use the slug name of the extension as argument. You can find the slug at the last part of the URL of the extension: https://addons.mozilla.org/en-US/firefox/addon/slug/. You can use this option multiple times to download multiple extensions. Additionally the following recommended extensions are downloaded: uBlock Origin, ClearURLs, Simple Temporary Containers, Bypass Twitter login wall")
+	flag.Var(&o.Extensions, "ext", "Extension to install in the profile. Accepts the slug name of an addons.mozilla.org extension (the last part of its URL: https://addons.mozilla.org/en-US/firefox/addon/slug/), an https:// URL pointing directly at an XPI file, a filesystem path to a local .xpi file, or a \"name:slug\" reference to a store registered with -ext-source. You can use this option multiple times to download multiple extensions. Additionally the following recommended extensions are downloaded: uBlock Origin, ClearURLs, Simple Temporary Containers, Bypass Twitter login wall")
+	flag.Var(&o.ExtSources, "ext-source", "Register an alternative extension store as name=url-template, where {slug} in the template is replaced with the part after the colon in a \"-ext name:slug\" argument. Example: -ext-source github=https://github.com/{slug}/releases/latest/download/{slug}.xpi -ext github:my-fork")
 	flag.BoolVar(&o.ExtensionNoRec, "ext-no-rec", false, "Do not download the recommended extensions (uBlock Origin, ClearURLs, Simple Temporary Containers, Bypass Twitter login wall)")
+	flag.StringVar(&o.LockPath, "lock", filepath.Join(os.TempDir(), appName, "tmpfox.lock"), "Path to the lock file that pins the resolved versions and SHA-256 hashes of user.js and extensions")
+	flag.BoolVar(&o.Frozen, "frozen", false, "Only install versions recorded in the lock file, and abort if a downloaded file's hash doesn't match")
+	flag.BoolVar(&o.UpdateLock, "update-lock", false, "Re-resolve user.js and extensions even if already present in the lock file, and update it with the new versions")
+	flag.IntVar(&o.Parallel, "parallel", 4, "Number of extensions to download concurrently")
+	flag.BoolVar(&o.Strict, "strict", false, "Abort immediately if any extension fails to download, instead of continuing with the others")
+	flag.StringVar(&o.FirefoxBin, "firefox", "", "Path to the firefox binary to use. If not set, the FIREFOX_BIN environment variable is used if set; otherwise firefox is looked up in PATH and in standard install locations, in a platform-dependent order.")
+	flag.BoolVar(&o.RandomUA, "random-ua", false, "Override the user-agent with a realistic Firefox version, chosen randomly weighted by real-world usage share")
+	flag.StringVar(&o.LogFormat, "log-format", "text", "Log output format: text or json")
+	flag.StringVar(&o.LogLevel, "log-level", "info", "Log level: debug, info, warn or error")
 	flag.Parse()
 	if !o.ExtensionNoRec {
 		o.Extensions["ublock-origin"] = struct{}{}
@@ -68,8 +89,14 @@ func main() {
 		o.Extensions["simple-temporary-containers"] = struct{}{}
 		o.Extensions["bypass-twitter-login-wall"] = struct{}{}
 	}
+	l, err := newLogger(o.LogFormat, o.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fatal error: %s\n", err)
+		os.Exit(1)
+	}
+	logger = l
 	if err := run(o); err != nil {
-		log.Printf("fatal error: %s\n", err)
+		logger.Error("fatal error", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 }
@@ -83,6 +110,9 @@ func run(o options) error {
 		fmt.Printf("%s\n\n[Third party licenses]\n\n%s\n", license, strings.Join(licenseDeps, "\n"))
 		return nil
 	}
+	if o.Frozen && o.UpdateLock {
+		return fmt.Errorf("-frozen and -update-lock are contradictory: -frozen verifies against the lock file, -update-lock re-resolves and overwrites it")
+	}
 
 	// cleanup
 	profileName, err := randomProfileName()
@@ -96,10 +126,10 @@ func run(o options) error {
 		if !o.Keep || !profileCreated {
 			err := os.RemoveAll(profileDirPath)
 			if err != nil {
-				log.Printf("failed to delete profile at %s - error: %s", profileDirPath, err)
+				logger.Error("failed to delete profile", slog.String("path", profileDirPath), slog.String("error", err.Error()))
 				return
 			}
-			log.Printf("deleted profile at %s", profileDirPath)
+			logger.Info("deleted profile", slog.String("path", profileDirPath))
 		}
 	}()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -111,19 +141,29 @@ func run(o options) error {
 		cancel()
 	}()
 
-	// create directories
-	err = os.MkdirAll(o.ProfilesDir, 0700)
-	if err != nil {
-		return fmt.Errorf("cannot create profiles directory: %s", err)
-	}
-	err = os.Mkdir(profileDirPath, 0700)
-	if err != nil {
-		return fmt.Errorf("cannot create profile directory: %s", err)
+	var profileExtensionsDirPath string
+	if err := withPhase("profile-create", func() error {
+		err := os.MkdirAll(o.ProfilesDir, 0700)
+		if err != nil {
+			return fmt.Errorf("cannot create profiles directory: %s", err)
+		}
+		err = os.Mkdir(profileDirPath, 0700)
+		if err != nil {
+			return fmt.Errorf("cannot create profile directory: %s", err)
+		}
+		profileExtensionsDirPath = filepath.Join(profileDirPath, "extensions")
+		err = os.MkdirAll(profileExtensionsDirPath, 0700)
+		if err != nil {
+			return fmt.Errorf("cannot create extensions directory: %s", err)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
-	profileExtensionsDirPath := filepath.Join(profileDirPath, "extensions")
-	err = os.MkdirAll(profileExtensionsDirPath, 0700)
+
+	firefoxBin, err := resolveFirefoxBin(o.FirefoxBin)
 	if err != nil {
-		return fmt.Errorf("cannot create extensions directory: %s", err)
+		return fmt.Errorf("failed to find firefox: %s", err)
 	}
 
 	if err = func() error {
@@ -135,112 +175,171 @@ func run(o options) error {
 			Timeout:   30 * time.Second,
 		}
 
+		// load the lock file, so that previously resolved versions can be reused and verified
+		lock, err := loadLockFile(o.LockPath)
+		if err != nil {
+			return fmt.Errorf("failed to load lock file: %s", err)
+		}
+		lockDirty := false
+
 		// download user.js file
 		userJsPath := filepath.Join(profileDirPath, "user.js")
 		if o.UserJsURL == notSetUserJsURL {
 			// if flag -userjs is not set, download an arkenfox version matching the installed firefox version
 
-			// find installed firefox version
-			output, err := exec.CommandContext(ctx, "firefox", "--version").Output()
-			if err != nil {
-				return fmt.Errorf("failed to run command 'firefox --version': %s", err)
-			}
-			r := regexp.MustCompile(`Mozilla Firefox ([0-9]+)\.[0-9]+\.[0-9]+`)
-			matches := r.FindSubmatch(output)
-			if len(matches) < 2 {
-				return fmt.Errorf("regular expression failed to find matches on the output of command 'firefox --version'")
-			}
-			firefoxVersionMajor, err := strconv.Atoi(string(matches[1]))
-			if err != nil {
-				return fmt.Errorf("failed to identify firefox version on the output of command 'firefox --version': %s", err)
-			}
-
-			// query github for all releases of arkenfox
-			tagsJSON, err := openURLHTML(ctx, client, fmt.Sprintf("https://api.github.com/repos/arkenfox/user.js/git/matching-refs/tags/%v.", firefoxVersionMajor))
-			if err != nil {
-				return fmt.Errorf("failed to query github: %s", err)
-			}
-			var tags []githubTag
-			if err := json.Unmarshal(tagsJSON, &tags); err != nil {
-				return fmt.Errorf("failed to unmarshal github response: %s", err)
-			}
-			if len(tags) == 0 {
-				log.Println("no matching arkefox version found. downloading latest.")
-				err = downloadFile(ctx, client, "https://raw.githubusercontent.com/arkenfox/user.js/master/user.js", userJsPath)
+			var versionString string
+			var firefoxVersion firefoxRelease
+			if err := withPhase("userjs-resolve", func() error {
+				// find installed firefox version
+				output, err := exec.CommandContext(ctx, firefoxBin, "--version").Output()
 				if err != nil {
-					return fmt.Errorf("failed to download user.js: %s", err)
+					return fmt.Errorf("failed to run command '%s --version': %s", firefoxBin, err)
 				}
-			} else {
-				var choosenTag githubTag
-				if len(tags) == 1 {
-					choosenTag = tags[0]
-				} else {
-					// if multiple matching tags have been found, choose the one with the highest minor version
-					var maxMinor int
-					for _, tag := range tags {
-						major, minor, err := tag.VersionMajorMinor()
-						if err != nil {
-							continue
-						}
-						if major != firefoxVersionMajor {
-							continue
-						}
-						if minor > maxMinor {
-							maxMinor = minor
-							choosenTag = tag
-						}
-					}
-				}
-				versionString, err := choosenTag.VersionString()
+				firefoxVersion, err = parseFirefoxVersion(output)
 				if err != nil {
-					return fmt.Errorf("invalid tag version")
+					return fmt.Errorf("failed to parse the output of command '%s --version': %s", firefoxBin, err)
 				}
-				zipURL := fmt.Sprintf("https://github.com/arkenfox/user.js/archive/refs/tags/%s.zip", versionString)
-				fmt.Println("url", zipURL)
-				zipPath := filepath.Join(profileDirPath, "arkenfox.zip")
-				err = downloadFile(ctx, client, zipURL, zipPath)
-				if err != nil {
-					return fmt.Errorf("failed to download user.js: %s", err)
+				logger.Debug("detected firefox version", slog.Int("firefox_major", firefoxVersion.Major), slog.String("channel", firefoxVersion.Channel))
+				firefoxVersionMajor := firefoxVersion.Major
+
+				// determine which arkenfox tag to use: reuse the one pinned in the
+				// lock file unless -update-lock was given, otherwise resolve it from github
+				versionString = lock.ArkenfoxTag
+				if versionString == "" && o.Frozen {
+					return fmt.Errorf("-frozen was given but lock file %s has no pinned arkenfox tag", o.LockPath)
 				}
-				defer func() {
-					err := os.Remove(zipPath)
+				if versionString == "" || o.UpdateLock {
+					// query github for all releases of arkenfox
+					tagsJSON, err := openURLHTML(ctx, client, fmt.Sprintf("https://api.github.com/repos/arkenfox/user.js/git/matching-refs/tags/%v.", firefoxVersionMajor))
 					if err != nil {
-						log.Printf("failed to delete arkenfox zip file at %s - error: %s", zipPath, err)
-						return
+						return fmt.Errorf("failed to query github: %s", err)
 					}
-				}()
-				zipReadCloser, err := zip.OpenReader(zipPath)
-				if err != nil {
-					return fmt.Errorf("failed to open zip: %s", err)
-				}
-				defer zipReadCloser.Close()
-				for _, fileInZip := range zipReadCloser.File {
-					if fileInZip.Name == fmt.Sprintf("user.js-%s/user.js", versionString) {
-						fo, err := fileInZip.Open()
-						if err != nil {
-							return fmt.Errorf("failed to open file in zip: %s", err)
+					var tags []githubTag
+					if err := json.Unmarshal(tagsJSON, &tags); err != nil {
+						return fmt.Errorf("failed to unmarshal github response: %s", err)
+					}
+					if len(tags) == 0 {
+						logger.Info("no matching arkenfox version found, downloading latest", slog.Int("firefox_major", firefoxVersionMajor))
+						versionString = ""
+					} else {
+						var choosenTag githubTag
+						if len(tags) == 1 {
+							choosenTag = tags[0]
+						} else {
+							// on Nightly/ESR, prefer a tag carrying that channel's suffix, if one exists
+							if firefoxVersion.Channel == "nightly" || firefoxVersion.Channel == "esr" {
+								for _, tag := range tags {
+									if strings.Contains(strings.ToLower(tag.Ref), firefoxVersion.Channel) {
+										choosenTag = tag
+										break
+									}
+								}
+							}
+							if choosenTag.Ref == "" {
+								// otherwise choose the one with the highest minor version
+								var maxMinor int
+								for _, tag := range tags {
+									major, minor, err := tag.VersionMajorMinor()
+									if err != nil {
+										continue
+									}
+									if major != firefoxVersionMajor {
+										continue
+									}
+									if minor > maxMinor {
+										maxMinor = minor
+										choosenTag = tag
+									}
+								}
+							}
 						}
-						defer fo.Close()
-						userJsFile, err := os.Create(userJsPath)
+						versionString, err = choosenTag.VersionString()
 						if err != nil {
-							return fmt.Errorf("failed to create file: %s", err)
+							return fmt.Errorf("invalid tag version")
 						}
-						_, err = io.Copy(userJsFile, fo)
+					}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if err := withPhase("userjs-download", func() error {
+				if versionString == "" {
+					if o.Frozen {
+						return fmt.Errorf("-frozen requires a pinned arkenfox tag, but none could be resolved")
+					}
+					err := downloadFile(ctx, client, "https://raw.githubusercontent.com/arkenfox/user.js/master/user.js", userJsPath, nil)
+					if err != nil {
+						return fmt.Errorf("failed to download user.js: %s", err)
+					}
+				} else {
+					zipURL := fmt.Sprintf("https://github.com/arkenfox/user.js/archive/refs/tags/%s.zip", versionString)
+					logger.Debug("downloading arkenfox archive", slog.String("url", zipURL))
+					zipPath := filepath.Join(profileDirPath, "arkenfox.zip")
+					err := downloadFile(ctx, client, zipURL, zipPath, nil)
+					if err != nil {
+						return fmt.Errorf("failed to download user.js: %s", err)
+					}
+					defer func() {
+						err := os.Remove(zipPath)
 						if err != nil {
-							return fmt.Errorf("failed to copy file from zip: %s", err)
+							logger.Error("failed to delete arkenfox zip file", slog.String("path", zipPath), slog.String("error", err.Error()))
+							return
+						}
+					}()
+					zipReadCloser, err := zip.OpenReader(zipPath)
+					if err != nil {
+						return fmt.Errorf("failed to open zip: %s", err)
+					}
+					defer zipReadCloser.Close()
+					for _, fileInZip := range zipReadCloser.File {
+						if fileInZip.Name == fmt.Sprintf("user.js-%s/user.js", versionString) {
+							fo, err := fileInZip.Open()
+							if err != nil {
+								return fmt.Errorf("failed to open file in zip: %s", err)
+							}
+							defer fo.Close()
+							userJsFile, err := os.Create(userJsPath)
+							if err != nil {
+								return fmt.Errorf("failed to create file: %s", err)
+							}
+							_, err = io.Copy(userJsFile, fo)
+							if err != nil {
+								return fmt.Errorf("failed to copy file from zip: %s", err)
+							}
+							break
 						}
-						break
 					}
 				}
-			}
-			// make sure user.js file has been downloaded
-			if _, err := os.Stat(userJsPath); err != nil {
-				return fmt.Errorf("failed to access user.js file: %s", err)
+				// make sure user.js file has been downloaded
+				if _, err := os.Stat(userJsPath); err != nil {
+					return fmt.Errorf("failed to access user.js file: %s", err)
+				}
+
+				// pin or verify the arkenfox version in the lock file
+				userJsSHA256, err := sha256File(userJsPath)
+				if err != nil {
+					return fmt.Errorf("failed to hash user.js: %s", err)
+				}
+				if lock.ArkenfoxSHA256 != "" && !o.UpdateLock {
+					if err := verifySHA256File(userJsPath, lock.ArkenfoxSHA256); err != nil {
+						return fmt.Errorf("user.js failed verification against lock file: %s", err)
+					}
+				} else {
+					lock.ArkenfoxTag = versionString
+					lock.ArkenfoxSHA256 = userJsSHA256
+					lockDirty = true
+				}
+				return nil
+			}); err != nil {
+				return err
 			}
 		} else if o.UserJsURL != "" {
-			log.Printf("downloading user.js %s --> %s", o.UserJsURL, userJsPath)
-			err = downloadFile(ctx, client, o.UserJsURL, userJsPath)
-			if err != nil {
+			if err := withPhase("userjs-download", func() error {
+				logger.Info("downloading user.js", slog.String("url", o.UserJsURL), slog.String("path", userJsPath))
+				return downloadFile(ctx, client, o.UserJsURL, userJsPath, nil)
+			}); err != nil {
 				return fmt.Errorf("failed to download user.js: %s", err)
 			}
 		}
@@ -256,6 +355,13 @@ func run(o options) error {
 			}
 			prefs = append(prefs, prefsIfExtensions...)
 		}
+		if o.RandomUA {
+			userAgent, err := randomUserAgent(ctx, client)
+			if err != nil {
+				return fmt.Errorf("failed to generate random user-agent: %s", err)
+			}
+			prefs = append(prefs, fmt.Sprintf(`user_pref("general.useragent.override", %q);`, userAgent))
+		}
 		f, err := os.OpenFile(userJsPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 		if err != nil {
 			return fmt.Errorf("failed to open %s - error: %s", userJsPath, err)
@@ -265,24 +371,27 @@ func run(o options) error {
 			return fmt.Errorf("failed to write to %s - error: %s", userJsPath, err)
 		}
 
-		// download extensions
-		for extensionSlug := range o.Extensions {
-			extensionPageURL := "https://addons.mozilla.org/en-US/firefox/addon/" + extensionSlug + "/"
-			log.Println("visiting", extensionPageURL)
-			pageHTML, err := openURLHTML(ctx, client, extensionPageURL)
-			if err != nil {
-				return fmt.Errorf("cannot open url %s - error: %s", extensionPageURL, err)
+		// download extensions concurrently; unless -strict or -frozen is given, a
+		// failed extension is logged and skipped rather than aborting the run
+		if err := withPhase("extensions-download", func() error {
+			extensionsLockDirty, err := downloadExtensions(ctx, client, o, lock, profileExtensionsDirPath)
+			if extensionsLockDirty {
+				lockDirty = true
 			}
-			extensionGUID, err := extractGUIDFromHTML(pageHTML)
 			if err != nil {
-				return fmt.Errorf("failed to extract GUID from html: %s", err)
+				if o.Strict || o.Frozen {
+					return err
+				}
+				logger.Error("some extensions failed to download", slog.String("error", err.Error()))
 			}
-			extensionXpiURL := "https://addons.mozilla.org/firefox/downloads/latest/" + extensionSlug + "/" + extensionSlug + ".xpi"
-			extensionXpiDownloadPath := filepath.Join(profileExtensionsDirPath, extensionGUID+".xpi")
-			log.Println("downloading extension", extensionXpiURL, "-->", extensionXpiDownloadPath)
-			err = downloadFile(ctx, client, extensionXpiURL, extensionXpiDownloadPath)
-			if err != nil {
-				return fmt.Errorf("failed to download extension from url %s - error: %s", extensionXpiURL, err)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to download extensions: %s", err)
+		}
+
+		if lockDirty || o.UpdateLock {
+			if err := lock.save(o.LockPath); err != nil {
+				return fmt.Errorf("failed to save lock file: %s", err)
 			}
 		}
 		return nil
@@ -292,13 +401,20 @@ func run(o options) error {
 	profileCreated = true
 
 	// start firefox
-	cmd := exec.CommandContext(ctx, "firefox", "--no-remote", "--profile", profileDirPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("firefox execution failed: %s", err)
-	}
-	return nil
+	return withPhase("firefox-launch", func() error {
+		cmd := exec.CommandContext(ctx, firefoxBin, "--no-remote", "--profile", profileDirPath)
+		stdout := &lineLogger{stage: "firefox-launch", stream: "stdout"}
+		stderr := &lineLogger{stage: "firefox-launch", stream: "stderr"}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		stdout.flush()
+		stderr.flush()
+		if err != nil {
+			return fmt.Errorf("firefox execution failed: %s", err)
+		}
+		return nil
+	})
 }
 
 func randomProfileName() (string, error) {
@@ -0,0 +1,52 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// GenericProgress describes how far a single file download has progressed.
+// BytesTotal is 0 when the server did not report a Content-Length.
+type GenericProgress struct {
+	BytesRead  int64
+	BytesTotal int64
+}
+
+// progressReporter aggregates per-file GenericProgress updates coming from
+// concurrent downloads into a single terminal progress line.
+type progressReporter struct {
+	mu    sync.Mutex
+	files map[string]GenericProgress
+}
+
+func newProgressReporter() *progressReporter {
+	return &progressReporter{files: make(map[string]GenericProgress)}
+}
+
+func (p *progressReporter) update(name string, progress GenericProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files[name] = progress
+	var bytesRead, bytesTotal int64
+	for _, f := range p.files {
+		bytesRead += f.BytesRead
+		bytesTotal += f.BytesTotal
+	}
+	if bytesTotal > 0 {
+		fmt.Printf("\rdownloading extensions: %d/%d bytes across %d files", bytesRead, bytesTotal, len(p.files))
+	} else {
+		fmt.Printf("\rdownloading extensions: %d bytes across %d files", bytesRead, len(p.files))
+	}
+}
+
+// done prints the trailing newline after the last progress update.
+func (p *progressReporter) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.files) > 0 {
+		fmt.Println()
+	}
+}
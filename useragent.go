@@ -0,0 +1,167 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const caniuseDataURL = "https://raw.githubusercontent.com/Fyrd/caniuse/master/fulldata-json/data-2.0.json"
+
+const caniuseCacheTTL = 24 * time.Hour
+
+// firefoxUsageVersion is one entry of caniuse's per-version global usage share for Firefox.
+type firefoxUsageVersion struct {
+	Version     string
+	GlobalUsage float64
+}
+
+type caniuseVersionEntry struct {
+	Version     string  `json:"version"`
+	GlobalUsage float64 `json:"global_usage"`
+}
+
+type caniuseData struct {
+	Agents struct {
+		Firefox struct {
+			VersionList []caniuseVersionEntry `json:"version_list"`
+		} `json:"firefox"`
+	} `json:"agents"`
+}
+
+// uaPlatformPool are the platform tokens that go into the UA string.
+var uaPlatformPool = []string{
+	"Windows NT 10.0; Win64; x64",
+	"Macintosh; Intel Mac OS X 10.15",
+	"X11; Linux x86_64",
+}
+
+// randomUserAgent returns a realistic Firefox user-agent string, with a
+// version weighted by real-world usage share as reported by caniuse.
+func randomUserAgent(ctx context.Context, client *http.Client) (string, error) {
+	versions, err := firefoxUsageVersions(ctx, client)
+	if err != nil {
+		return "", fmt.Errorf("failed to load firefox usage data: %s", err)
+	}
+	chosen, err := pickWeightedVersion(versions)
+	if err != nil {
+		return "", fmt.Errorf("failed to pick a firefox version: %s", err)
+	}
+	major, err := firefoxVersionMajor(chosen.Version)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse firefox version %q: %s", chosen.Version, err)
+	}
+	platform, err := pickRandom(uaPlatformPool)
+	if err != nil {
+		return "", fmt.Errorf("failed to pick a platform: %s", err)
+	}
+	return fmt.Sprintf("Mozilla/5.0 (%s; rv:%d.0) Gecko/20100101 Firefox/%d.0", platform, major, major), nil
+}
+
+// firefoxUsageVersions returns Firefox versions with non-zero global usage
+// share, caching caniuse's dataset under os.UserCacheDir()/tmpfox/agents.json.
+func firefoxUsageVersions(ctx context.Context, client *http.Client) ([]firefoxUsageVersion, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine user cache directory: %s", err)
+	}
+	cachePath := filepath.Join(cacheDir, appName, "agents.json")
+
+	data, err := readCacheIfFresh(cachePath, caniuseCacheTTL)
+	if err != nil {
+		data, err = openURLHTML(ctx, client, caniuseDataURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %s", caniuseDataURL, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %s", err)
+		}
+		if err := os.WriteFile(cachePath, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write cache file %s: %s", cachePath, err)
+		}
+	}
+
+	var caniuse caniuseData
+	if err := json.Unmarshal(data, &caniuse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal caniuse data: %s", err)
+	}
+
+	var versions []firefoxUsageVersion
+	for _, v := range caniuse.Agents.Firefox.VersionList {
+		if v.GlobalUsage <= 0 {
+			continue
+		}
+		versions = append(versions, firefoxUsageVersion{Version: v.Version, GlobalUsage: v.GlobalUsage})
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no firefox versions with non-zero global usage found")
+	}
+	return versions, nil
+}
+
+// readCacheIfFresh returns the contents of path if it was modified within ttl, and an error otherwise.
+func readCacheIfFresh(path string, ttl time.Duration) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cache file %s not accessible: %s", path, err)
+	}
+	if time.Since(info.ModTime()) > ttl {
+		return nil, fmt.Errorf("cache file %s is older than %s", path, ttl)
+	}
+	return os.ReadFile(path)
+}
+
+// pickWeightedVersion picks a version using crypto/rand, weighted by GlobalUsage.
+func pickWeightedVersion(versions []firefoxUsageVersion) (firefoxUsageVersion, error) {
+	var total float64
+	for _, v := range versions {
+		total += v.GlobalUsage
+	}
+	// scale to an integer range so crypto/rand/big.Int can be used
+	const scale = 1_000_000
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(total*scale)))
+	if err != nil {
+		return firefoxUsageVersion{}, fmt.Errorf("random number generator failed: %s", err)
+	}
+	target := float64(n.Int64()) / scale
+	var cumulative float64
+	for _, v := range versions {
+		cumulative += v.GlobalUsage
+		if target < cumulative {
+			return v, nil
+		}
+	}
+	return versions[len(versions)-1], nil
+}
+
+// pickRandom picks a uniformly random element from choices using crypto/rand.
+func pickRandom(choices []string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(choices))))
+	if err != nil {
+		return "", fmt.Errorf("random number generator failed: %s", err)
+	}
+	return choices[n.Int64()], nil
+}
+
+var firefoxVersionMajorRegexp = regexp.MustCompile(`^([0-9]+)`)
+
+// firefoxVersionMajor extracts the leading major version number from a
+// caniuse version string, e.g. "124" or "124.0" -> 124.
+func firefoxVersionMajor(version string) (int, error) {
+	matches := firefoxVersionMajorRegexp.FindStringSubmatch(version)
+	if len(matches) < 2 {
+		return 0, fmt.Errorf("no leading version number found")
+	}
+	return strconv.Atoi(matches[1])
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2021 Charalampos Mitsakis (go.mitsakis.org/tmpfox)
+// Licensed under the EUPL-1.2-or-later
+package main
+
+import "testing"
+
+func TestFirefoxVersionMajor(t *testing.T) {
+	tests := []struct {
+		version string
+		want    int
+	}{
+		{"124", 124},
+		{"124.0", 124},
+		{"99.0.1", 99},
+	}
+	for _, tt := range tests {
+		got, err := firefoxVersionMajor(tt.version)
+		if err != nil {
+			t.Fatalf("firefoxVersionMajor(%q): unexpected error: %s", tt.version, err)
+		}
+		if got != tt.want {
+			t.Fatalf("firefoxVersionMajor(%q) = %d, want %d", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestFirefoxVersionMajorInvalid(t *testing.T) {
+	if _, err := firefoxVersionMajor("esr"); err == nil {
+		t.Fatal("expected an error for a version with no leading number")
+	}
+}
+
+func TestPickWeightedVersionNeverPicksAZeroWeightVersion(t *testing.T) {
+	versions := []firefoxUsageVersion{
+		{Version: "123", GlobalUsage: 0},
+		{Version: "124", GlobalUsage: 1},
+	}
+	for i := 0; i < 200; i++ {
+		v, err := pickWeightedVersion(versions)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if v.Version != "124" {
+			t.Fatalf("picked %s, which has zero weight", v.Version)
+		}
+	}
+}
+
+func TestPickWeightedVersionCoversAllNonZeroWeights(t *testing.T) {
+	versions := []firefoxUsageVersion{
+		{Version: "123", GlobalUsage: 1},
+		{Version: "124", GlobalUsage: 1},
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		v, err := pickWeightedVersion(versions)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		seen[v.Version] = true
+	}
+	for _, v := range versions {
+		if !seen[v.Version] {
+			t.Fatalf("version %s was never picked across 200 draws of two equally-weighted versions", v.Version)
+		}
+	}
+}
+
+func TestPickWeightedVersionSingleChoice(t *testing.T) {
+	versions := []firefoxUsageVersion{{Version: "124", GlobalUsage: 5}}
+	v, err := pickWeightedVersion(versions)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v.Version != "124" {
+		t.Fatalf("got %q, want %q", v.Version, "124")
+	}
+}